@@ -10,22 +10,88 @@ package changefeedccl
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
 	"sync/atomic"
 
 	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/parquet"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
+// changefeedSinkCloudStorageMemoryBudget bounds how many bytes a single
+// cloudStorageSink may buffer in memory across all of its open files before
+// it starts proactively flushing or spilling to disk. The sink does not read
+// this setting itself: it is held to the budget of whatever mon.BoundAccount
+// is passed to makeCloudStorageSink, and nothing in this package sizes that
+// account from this setting.
+var changefeedSinkCloudStorageMemoryBudget = settings.RegisterByteSizeSetting(
+	"changefeed.sink.cloud_storage.memory_budget",
+	"the maximum amount of memory a cloud storage sink may buffer before flushing or spilling to disk",
+	64<<20, // 64MiB
+)
+
+var cloudStorageSinkMemoryHighWaterMetadata = metric.Metadata{
+	Name:        "changefeed.sink.cloud_storage.memory_high_water",
+	Help:        "Maximum number of bytes a cloud storage sink has buffered in memory at once",
+	Measurement: "Bytes",
+	Unit:        metric.Unit_BYTES,
+}
+
+// defaultCloudStorageSinkChunkSize is the default size (in uncompressed
+// bytes) of each independently-decodable compression chunk. It can be
+// overridden with the `chunk_size` sink option.
+const defaultCloudStorageSinkChunkSize = 512 << 10 // 512KiB
+
+// cloudStorageSinkChunkIndexEntry describes one independently-decodable
+// compression chunk within a data file. It's the unit recorded in the
+// `<name>.index` sidecar file so that a consumer can seek directly to the
+// chunk covering a given timestamp without decompressing the whole object.
+type cloudStorageSinkChunkIndexEntry struct {
+	UncompressedOffset int64         `json:"uncompressed_offset"`
+	CompressedOffset   int64         `json:"compressed_offset"`
+	FirstTimestamp     hlc.Timestamp `json:"first_timestamp"`
+	LastTimestamp      hlc.Timestamp `json:"last_timestamp"`
+}
+
+// cloudStorageSinkIndex is the contents of a `<name>.index` sidecar file.
+type cloudStorageSinkIndex struct {
+	Chunks []cloudStorageSinkChunkIndexEntry `json:"chunks"`
+}
+
+// newCompressionWriterFn wraps w with a streaming compressor. Closing the
+// returned writer finalizes one independently-decodable frame; a fresh
+// writer must be created for the next frame.
+type newCompressionWriterFn func(w io.Writer) (io.WriteCloser, error)
+
+func newGzipCompressionWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func newZstdCompressionWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
 func isCloudStorageSink(u *url.URL) bool {
 	switch u.Scheme {
 	case `experimental-s3`, `experimental-gs`, `experimental-nodelocal`, `experimental-http`,
@@ -54,6 +120,124 @@ type cloudStorageSinkKey struct {
 type cloudStorageSinkFile struct {
 	leastResolvedTs hlc.Timestamp
 	buf             bytes.Buffer
+
+	// rawBytesWritten is the count of uncompressed bytes written to the file
+	// so far, used to compute each chunk's uncompressed offset.
+	rawBytesWritten int64
+
+	// compressor is the writer for the currently-open compression chunk, or
+	// nil if compression is disabled or no chunk is currently open.
+	compressor         io.WriteCloser
+	chunkCompressedBeg int64
+	chunkRawWritten    int64
+	chunkFirstTs       hlc.Timestamp
+	chunkLastTs        hlc.Timestamp
+
+	index []cloudStorageSinkChunkIndexEntry
+
+	// ocfHeaderWritten and ocfSyncMarker track the Avro Object Container File
+	// state for this file, and are unused outside of `format=experimental_avro`.
+	// The header (including the file's pinned schema) is written once, before
+	// the first record.
+	ocfHeaderWritten bool
+	ocfSyncMarker    [16]byte
+
+	// accountedBytes is how many of this file's buffered bytes are currently
+	// charged against the sink's memory account. It's usually equal to
+	// buf.Len(), except once the file has spilled, at which point it's 0:
+	// the bytes live on disk instead and no longer count against the budget.
+	// For `format=parquet` it's instead the sum of the per-row estimates of
+	// the rows held in the file's open row group, since buf stays empty until
+	// flushFile closes it.
+	accountedBytes int64
+	// spill is non-nil once this file's buffer has been moved to a temporary
+	// on-disk file, which happens when growing the sink's memory account
+	// would exceed the account's budget and there's no other open file big
+	// enough to flush to make room.
+	spill *cloudStorageSinkSpillFile
+
+	// parquetWriter is unused outside of `format=parquet`. It's created at
+	// file creation, pinning the file's schema, and buffers the file's
+	// single row group in memory until flushFile closes it, at which point
+	// it writes the row group and footer through a cloudStorageSinkFileWriter
+	// rather than a writer captured at creation time -- reserveMemory may
+	// spill this file to disk at any point between the writer's creation and
+	// its Close, and the bytes must land wherever file.out() points at the
+	// time they're actually produced.
+	parquetWriter *parquet.Writer
+}
+
+// out returns the writer that new bytes for this file should be appended
+// to: the in-memory buffer, or the on-disk spill file once one exists.
+func (f *cloudStorageSinkFile) out() io.Writer {
+	if f.spill != nil {
+		return f.spill
+	}
+	return &f.buf
+}
+
+// outLen returns the number of bytes currently buffered for this file,
+// in-memory or spilled.
+func (f *cloudStorageSinkFile) outLen() int64 {
+	if f.spill != nil {
+		return f.spill.len
+	}
+	return int64(f.buf.Len())
+}
+
+// cloudStorageSinkFileWriter is a stable io.Writer for a cloudStorageSinkFile
+// that re-resolves file.out() on every call rather than pinning it once.
+// It exists for writers like parquet.Writer that are handed an io.Writer at
+// creation but don't actually write to it until some later Close call: by
+// then, file.out() may have changed out from under a writer that captured
+// it directly, e.g. because the file spilled to disk in the interim.
+type cloudStorageSinkFileWriter struct {
+	file *cloudStorageSinkFile
+}
+
+func (w cloudStorageSinkFileWriter) Write(p []byte) (int, error) {
+	return w.file.out().Write(p)
+}
+
+// cloudStorageSinkSpillFile is a temporary on-disk file that a
+// cloudStorageSinkFile's buffer is moved to when memory is scarce. It's
+// read back from and removed once its data has been uploaded.
+type cloudStorageSinkSpillFile struct {
+	f   *os.File
+	len int64
+}
+
+func newCloudStorageSinkSpillFile() (*cloudStorageSinkSpillFile, error) {
+	f, err := ioutil.TempFile(``, `changefeed-cloudstorage-sink-spill`)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudStorageSinkSpillFile{f: f}, nil
+}
+
+func (s *cloudStorageSinkSpillFile) Write(p []byte) (int, error) {
+	n, err := s.f.Write(p)
+	s.len += int64(n)
+	return n, err
+}
+
+// reader seeks the spill file back to the beginning so its full contents can
+// be uploaded.
+func (s *cloudStorageSinkSpillFile) reader() (io.Reader, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.f, nil
+}
+
+// close closes and removes the underlying temporary file.
+func (s *cloudStorageSinkSpillFile) close() error {
+	name := s.f.Name()
+	closeErr := s.f.Close()
+	if err := os.Remove(name); err != nil && closeErr == nil {
+		closeErr = err
+	}
+	return closeErr
 }
 
 // cloudStorageSink emits to files on cloud storage.
@@ -80,7 +264,19 @@ type cloudStorageSinkFile struct {
 //
 // `<ext>` implies the format of the file: currently the only option is
 // `ndjson`, which means a text file conforming to the "Newline Delimited JSON"
-// spec.
+// spec. If the `compression` option is set, `<ext>` additionally carries the
+// codec, e.g. `ndjson.gz` or `ndjson.zst`.
+//
+// When compression is enabled, a data file is not a single compressed
+// stream. Instead, it's a sequence of independently-decodable compression
+// chunks, each aligned to a record boundary, so that a consumer can
+// decompress (and thus range-read or resume from) any one chunk without
+// needing the rest of the file. A new chunk is started whenever the
+// previous one accumulates more than `chunk_size` bytes of uncompressed
+// data (512KiB by default) or whenever a new data file is started. The
+// offsets of every chunk, along with the timestamps of its first and last
+// record, are recorded in a `<name>.index` JSON sidecar file written next
+// to the data file.
 //
 // Each record in the data files is a value, keys are not included, so the
 // `envelope` option must be set to `value_only`. Within a file, records are not
@@ -95,7 +291,30 @@ type cloudStorageSinkFile struct {
 // deleted, included in hive queries, etc). A typical user of cloudStorageSink
 // would periodically do exactly this.
 //
-// Still TODO is writing out data schemas, Avro support, bounding memory usage.
+// `format=experimental_avro` writes Avro Object Container Files instead of
+// ndjson: each data file starts with a header pinning the Avro schema for
+// every record that follows (schema changes already roll to a new file, per
+// `<schema_id>` above), and records are wrapped in OCF blocks rather than
+// newline-delimited.
+//
+// Memory usage is bounded by acc, a mon.BoundAccount supplied by the caller
+// of makeCloudStorageSink: EmitRow grows it for every byte actually
+// buffered (post-compression, when compression is enabled; for
+// `format=parquet`, by a per-row estimate, since rows stay in the writer's
+// row group until flushFile) and flushFile shrinks it back on upload. When growing it would exceed the budget, the
+// sink first tries to free room by flushing its largest other open file,
+// and failing that, spills the current file's buffer to a temporary
+// on-disk file and keeps appending there instead.
+//
+// `format=parquet` writes columnar files for ingestion by tools like
+// Hive/Presto/BigQuery. The Parquet schema for a file is derived from the
+// table descriptor once, at file creation, and every EmitRow call appends
+// to that file's single row group; flushFile is what closes the row group,
+// writes the footer, and uploads, so a file always holds exactly one
+// (complete) row group. A `compression=snappy|gzip|zstd` option selects the
+// per-column-chunk codec.
+//
+// Still TODO is writing out data schemas for the ndjson format.
 type cloudStorageSink struct {
 	nodeID            roachpb.NodeID
 	sinkID            int64
@@ -105,6 +324,22 @@ type cloudStorageSink struct {
 
 	ext           string
 	recordDelimFn func(io.Writer) error
+	// ocf is true when the sink is writing Avro Object Container Files
+	// (`format=experimental_avro`) rather than ndjson.
+	ocf bool
+	// parquet is true when the sink is writing Parquet files
+	// (`format=parquet`) rather than ndjson. parquetCompression, if set, is
+	// the per-column-chunk codec (distinct from newCompressionWriter, which
+	// wraps ndjson/avro output in an outer compressed stream).
+	parquet            bool
+	parquetCompression string
+
+	newCompressionWriter newCompressionWriterFn
+	chunkSize            int64
+
+	acc                *mon.BoundAccount
+	memoryHighWater    *metric.Gauge
+	memoryHighWaterMax int64
 
 	es               storageccl.ExportStorage
 	fileID           int64
@@ -116,6 +351,11 @@ type cloudStorageSink struct {
 
 var cloudStorageSinkIDAtomic int64
 
+// makeCloudStorageSink constructs a cloudStorageSink. acc is the
+// mon.BoundAccount the sink charges its in-memory buffering against (see
+// reserveMemory); it is owned by the caller (the changefeed job setting up
+// the sink), which must size and close it -- this function only stores the
+// pointer.
 func makeCloudStorageSink(
 	baseURI string,
 	nodeID roachpb.NodeID,
@@ -125,6 +365,7 @@ func makeCloudStorageSink(
 	opts map[string]string,
 	watchedSF *spanFrontier,
 	initialHighWater hlc.Timestamp,
+	acc *mon.BoundAccount,
 ) (Sink, error) {
 	// Date partitioning is pretty standard, so no override for now, but we could
 	// plumb one down if someone needs it.
@@ -141,6 +382,9 @@ func makeCloudStorageSink(
 		sf:                watchedSF,
 		initialHighWater:  initialHighWater,
 		jobSessionID:      sessionID,
+		chunkSize:         defaultCloudStorageSinkChunkSize,
+		acc:               acc,
+		memoryHighWater:   metric.NewGauge(cloudStorageSinkMemoryHighWaterMetadata),
 	}
 
 	switch formatType(opts[optFormat]) {
@@ -152,11 +396,55 @@ func makeCloudStorageSink(
 			_, err := w.Write([]byte{'\n'})
 			return err
 		}
+	case optFormatAvro:
+		// Avro records are self-delimiting: each one is wrapped in its own
+		// OCF block by writeAvroOCFBlock, so there's no separator to add.
+		s.ext = `.avro`
+		s.ocf = true
+		s.recordDelimFn = func(io.Writer) error { return nil }
+	case optFormatParquet:
+		// Parquet files are columnar, not record-delimited: rows are
+		// buffered into the file's row group by writeParquetRow.
+		s.ext = `.parquet`
+		s.parquet = true
+		s.recordDelimFn = func(io.Writer) error { return nil }
 	default:
 		return nil, errors.Errorf(`this sink is incompatible with %s=%s`,
 			optFormat, opts[optFormat])
 	}
 
+	if compression := opts[optCompression]; compression != `` {
+		if s.parquet {
+			// Parquet compresses per column chunk internally, so unlike
+			// ndjson/avro there's no outer framing to add and no extension
+			// suffix to append.
+			switch compression {
+			case `snappy`, `gzip`, `zstd`:
+				s.parquetCompression = compression
+			default:
+				return nil, errors.Errorf(`unsupported parquet compression type %s`, compression)
+			}
+		} else {
+			switch compression {
+			case `gzip`:
+				s.ext = s.ext + `.gz`
+				s.newCompressionWriter = newGzipCompressionWriter
+			case `zstd`:
+				s.ext = s.ext + `.zst`
+				s.newCompressionWriter = newZstdCompressionWriter
+			default:
+				return nil, errors.Errorf(`unsupported compression type %s`, compression)
+			}
+			if chunkSizeStr, ok := opts[optCompressionChunkSize]; ok {
+				chunkSize, err := strconv.ParseInt(chunkSizeStr, 10, 64)
+				if err != nil {
+					return nil, errors.Wrapf(err, `parsing %s`, optCompressionChunkSize)
+				}
+				s.chunkSize = chunkSize
+			}
+		}
+	}
+
 	switch envelopeType(opts[optEnvelope]) {
 	case optEnvelopeWrapped:
 	default:
@@ -208,15 +496,94 @@ func (s *cloudStorageSink) EmitRow(
 		return nil
 	}
 
-	// TODO(dan): Memory monitoring for this
-	if _, err := file.buf.Write(value); err != nil {
+	// Grow the memory account by a conservative estimate before writing so
+	// that, if the budget would be exceeded, we can free room or spill
+	// before any bytes land in file.buf.
+	memEstimate := int64(len(value)) + 64
+	if err := s.reserveMemory(ctx, key, file, memEstimate); err != nil {
 		return err
 	}
-	if err := s.recordDelimFn(&file.buf); err != nil {
+
+	// outLenBeforeWrite lets the reconciliation below measure how many bytes
+	// actually ended up buffered, rather than assuming it matches the
+	// uncompressed record size: see the comment there.
+	outLenBeforeWrite := file.outLen()
+
+	w, err := s.chunkWriter(file, updated)
+	if err != nil {
 		return err
 	}
 
-	if int64(file.buf.Len()) > s.targetMaxFileSize {
+	var written int64
+	switch {
+	case s.parquet:
+		if file.parquetWriter == nil {
+			// Deliberately not w: see cloudStorageSinkFileWriter.
+			pw, err := s.newParquetWriter(cloudStorageSinkFileWriter{file: file}, table)
+			if err != nil {
+				return err
+			}
+			file.parquetWriter = pw
+		}
+		n, err := s.writeParquetRow(file, table, value, updated)
+		if err != nil {
+			return err
+		}
+		written = n
+	case s.ocf:
+		if !file.ocfHeaderWritten {
+			n, err := s.writeAvroOCFHeader(w, file, table)
+			if err != nil {
+				return err
+			}
+			written += n
+		}
+		n, err := s.writeAvroOCFBlock(w, file, value)
+		if err != nil {
+			return err
+		}
+		written += n
+	default:
+		n, err := w.Write(value)
+		if err != nil {
+			return err
+		}
+		if err := s.recordDelimFn(w); err != nil {
+			return err
+		}
+		written = int64(n) + 1
+	}
+	file.rawBytesWritten += written
+	file.chunkRawWritten += written
+	file.chunkLastTs = updated
+
+	if s.newCompressionWriter != nil && file.chunkRawWritten > s.chunkSize {
+		if err := s.finalizeChunk(file); err != nil {
+			return err
+		}
+	}
+
+	// Reconcile the estimate above with what's actually buffered now. written
+	// is the uncompressed record size, but when compression is enabled the
+	// compressor may buffer internally and flush fewer bytes (or, once
+	// finalizeChunk above has run, a burst of previously-buffered bytes) to
+	// file.out() than that -- so measure the real delta via outLen() rather
+	// than assuming the two match. If the file has since spilled, its bytes
+	// are no longer charged to the account at all.
+	//
+	// Parquet is exempt from this: a row handed to parquetWriter.AddRow
+	// lives in its internal row-group buffer, not in file.buf/file.spill,
+	// until flushFile's Close, so outLen() never moves and there is no
+	// better number to reconcile down to -- memEstimate is left charged in
+	// full until the row group closes. See reserveMemory and fileSize.
+	if file.spill == nil && !s.parquet {
+		bufferedDelta := file.outLen() - outLenBeforeWrite
+		if err := s.growAccount(ctx, file, bufferedDelta-memEstimate); err != nil {
+			return err
+		}
+	}
+
+	if s.fileSize(file) > s.targetMaxFileSize {
 		if err := s.flushFile(ctx, key, file); err != nil {
 			return err
 		}
@@ -225,6 +592,426 @@ func (s *cloudStorageSink) EmitRow(
 	return nil
 }
 
+// fileSize estimates how many bytes file currently holds, for the purposes
+// of deciding when to roll to a new file. For ndjson/avro this is exactly
+// the number of bytes buffered so far. Parquet's row group isn't flushed to
+// file.buf until its row group is closed, so rawBytesWritten -- the
+// cumulative size of the rows handed to the writer -- is used as an
+// estimate instead.
+func (s *cloudStorageSink) fileSize(file *cloudStorageSinkFile) int64 {
+	if s.parquet {
+		return file.rawBytesWritten
+	}
+	return file.outLen()
+}
+
+// newParquetWriter creates the Parquet writer for a new file, pinning its
+// schema (derived from table, plus the two `__crdb__` metadata columns
+// writeParquetRow populates on every row) and its column-chunk compression
+// codec for the file's lifetime.
+func (s *cloudStorageSink) newParquetWriter(
+	w io.Writer, table *sqlbase.TableDescriptor,
+) (*parquet.Writer, error) {
+	schema, err := parquetSchemaForTable(table, true /* includeCRDBMetadata */)
+	if err != nil {
+		return nil, err
+	}
+	var opts []parquet.Option
+	if s.parquetCompression != `` {
+		opts = append(opts, parquet.WithCompressionCodec(s.parquetCompression))
+	}
+	return parquet.NewWriter(schema, w, opts...)
+}
+
+// parquetValueForColumn converts decoded -- a value produced by
+// encoding/json, which represents every JSON number as a float64 and leaves
+// everything else as a string, bool, or nil -- into the Go value col's
+// Parquet type expects. A missing or JSON null field converts to Go nil for
+// every column type.
+func parquetValueForColumn(col sqlbase.ColumnDescriptor, decoded interface{}) (interface{}, error) {
+	if decoded == nil {
+		return nil, nil
+	}
+	switch col.Type.SemanticType {
+	case sqlbase.ColumnType_BOOL:
+		v, ok := decoded.(bool)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected bool, got %T`, col.Name, decoded)
+		}
+		return v, nil
+	case sqlbase.ColumnType_INT:
+		v, ok := decoded.(float64)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected number, got %T`, col.Name, decoded)
+		}
+		return int64(v), nil
+	case sqlbase.ColumnType_FLOAT:
+		v, ok := decoded.(float64)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected number, got %T`, col.Name, decoded)
+		}
+		return v, nil
+	case sqlbase.ColumnType_DECIMAL:
+		// The wrapped envelope encodes DECIMAL columns as their canonical
+		// string representation, so no precision is lost to float64.
+		v, ok := decoded.(string)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected decimal string, got %T`, col.Name, decoded)
+		}
+		return v, nil
+	case sqlbase.ColumnType_BYTES:
+		v, ok := decoded.(string)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected base64 string, got %T`, col.Name, decoded)
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, `column %s: decoding bytes`, col.Name)
+		}
+		return b, nil
+	case sqlbase.ColumnType_DATE, sqlbase.ColumnType_TIMESTAMP, sqlbase.ColumnType_TIMESTAMPTZ:
+		v, ok := decoded.(string)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected timestamp string, got %T`, col.Name, decoded)
+		}
+		return v, nil
+	default:
+		v, ok := decoded.(string)
+		if !ok {
+			return nil, errors.Errorf(`column %s: expected string, got %T`, col.Name, decoded)
+		}
+		return v, nil
+	}
+}
+
+// writeParquetRow decodes value -- the same wrapped-envelope JSON the
+// ndjson format would have written verbatim -- into a row matching table's
+// columns (converting each field from its JSON representation to col's
+// actual Parquet type), appends the row's `__crdb__` metadata (updated ts,
+// mvcc ts), and hands the result to file's row group. It returns the number
+// of (uncompressed, pre-columnar) bytes the row represents, used as
+// fileSize's size estimate.
+func (s *cloudStorageSink) writeParquetRow(
+	file *cloudStorageSinkFile, table *sqlbase.TableDescriptor, value []byte, updated hlc.Timestamp,
+) (int64, error) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return 0, err
+	}
+	row := make([]interface{}, 0, len(table.Columns)+2)
+	for _, col := range table.Columns {
+		v, err := parquetValueForColumn(col, decoded[col.Name])
+		if err != nil {
+			return 0, err
+		}
+		row = append(row, v)
+	}
+	// The `updated` timestamp is both the row's logical update time and its
+	// MVCC commit timestamp, so it's the source for both `__crdb__` columns:
+	// the timestamp's String() form, and the raw MVCC wall time a Parquet
+	// reader can use without parsing it.
+	row = append(row, updated.String(), updated.WallTime)
+	if err := file.parquetWriter.AddRow(row); err != nil {
+		return 0, err
+	}
+	return int64(len(value)), nil
+}
+
+// chunkWriter returns the io.Writer that a record should be written to,
+// opening a new compression chunk first if necessary. If compression is
+// disabled, records are written directly to the file's buffer.
+func (s *cloudStorageSink) chunkWriter(
+	file *cloudStorageSinkFile, updated hlc.Timestamp,
+) (io.Writer, error) {
+	if s.newCompressionWriter == nil {
+		return file.out(), nil
+	}
+	if file.compressor == nil {
+		compressor, err := s.newCompressionWriter(file.out())
+		if err != nil {
+			return nil, err
+		}
+		file.compressor = compressor
+		file.chunkCompressedBeg = file.outLen()
+		file.chunkRawWritten = 0
+		file.chunkFirstTs = updated
+	}
+	return file.compressor, nil
+}
+
+// finalizeChunk closes out the currently open compression chunk (if any),
+// flushing it to file.out() and recording its bounds in file.index. Once
+// closed, a chunk is independently decodable: the bytes from
+// chunkCompressedBeg to file.outLen() form a complete compressed stream.
+func (s *cloudStorageSink) finalizeChunk(file *cloudStorageSinkFile) error {
+	if file.compressor == nil {
+		return nil
+	}
+	if err := file.compressor.Close(); err != nil {
+		return err
+	}
+	file.index = append(file.index, cloudStorageSinkChunkIndexEntry{
+		UncompressedOffset: file.rawBytesWritten - file.chunkRawWritten,
+		CompressedOffset:   file.chunkCompressedBeg,
+		FirstTimestamp:     file.chunkFirstTs,
+		LastTimestamp:      file.chunkLastTs,
+	})
+	file.compressor = nil
+	file.chunkRawWritten = 0
+	return nil
+}
+
+// reserveMemory grows the sink's memory account by estimate bytes on behalf
+// of file, making room first if necessary: first by flushing the largest
+// other open file, and if that isn't enough, by spilling file's own buffer
+// to disk, at which point its writes stop being charged to the account
+// altogether. It's a no-op when the sink has no account (acc == nil).
+//
+// Parquet files are the exception to all of the above: a row handed to
+// parquetWriter.AddRow lives in its internal row-group buffer regardless of
+// file.spill, so (a) spilling doesn't free any memory for them, and so is
+// never attempted, and (b) their writes keep needing real accounting even
+// after file.spill is set, unlike every other format. If flushing every
+// other open file still doesn't make room, there's no way left to relieve
+// pressure short of closing this file's row group early, which reserveMemory
+// isn't positioned to do -- so the budget error is surfaced to the caller
+// instead of silently admitting unaccounted memory.
+func (s *cloudStorageSink) reserveMemory(
+	ctx context.Context, key cloudStorageSinkKey, file *cloudStorageSinkFile, estimate int64,
+) error {
+	if s.acc == nil {
+		return nil
+	}
+	if file.spill != nil && !s.parquet {
+		return nil
+	}
+	if err := s.acc.Grow(ctx, estimate); err == nil {
+		file.accountedBytes += estimate
+		s.noteMemoryHighWater()
+		return nil
+	}
+	if err := s.flushLargestOtherFile(ctx, key); err != nil {
+		return err
+	}
+	if err := s.acc.Grow(ctx, estimate); err == nil {
+		file.accountedBytes += estimate
+		s.noteMemoryHighWater()
+		return nil
+	} else if s.parquet {
+		return err
+	} else {
+		return s.spillToDisk(ctx, file)
+	}
+}
+
+// growAccount reconciles the account for file by delta bytes, which may be
+// negative (e.g. an earlier reservation turned out to be an overestimate).
+// It's a no-op once file has spilled, since spilled bytes aren't charged to
+// the account.
+func (s *cloudStorageSink) growAccount(
+	ctx context.Context, file *cloudStorageSinkFile, delta int64,
+) error {
+	if s.acc == nil || delta == 0 {
+		return nil
+	}
+	if delta > 0 {
+		if err := s.acc.Grow(ctx, delta); err != nil {
+			return err
+		}
+	} else {
+		s.acc.Shrink(ctx, -delta)
+	}
+	file.accountedBytes += delta
+	s.noteMemoryHighWater()
+	return nil
+}
+
+// noteMemoryHighWater updates the sink's high-water metric if the account's
+// current usage is a new maximum.
+func (s *cloudStorageSink) noteMemoryHighWater() {
+	if s.acc == nil || s.memoryHighWater == nil {
+		return
+	}
+	if used := s.acc.Used(); used > s.memoryHighWaterMax {
+		s.memoryHighWaterMax = used
+		s.memoryHighWater.Update(used)
+	}
+}
+
+// flushLargestOtherFile flushes and uploads whichever currently-open file
+// (other than except) holds the most in-memory bytes, freeing its share of
+// the memory account. It's a no-op if there are no other open files. A
+// non-parquet file that has already spilled is skipped: its bytes are
+// already off the account. A parquet file is never skipped for having
+// spilled, since -- unlike every other format -- spilling doesn't move its
+// row-group bytes out of memory, so fileSize (not outLen, which stays at 0
+// for an unflushed parquet file) is what ranks candidates here.
+func (s *cloudStorageSink) flushLargestOtherFile(ctx context.Context, except cloudStorageSinkKey) error {
+	var largestKey cloudStorageSinkKey
+	var largest *cloudStorageSinkFile
+	for k, f := range s.files {
+		if k == except {
+			continue
+		}
+		if f.spill != nil && f.parquetWriter == nil {
+			continue
+		}
+		if largest == nil || s.fileSize(f) > s.fileSize(largest) {
+			largestKey, largest = k, f
+		}
+	}
+	if largest == nil {
+		return nil
+	}
+	if err := s.flushFile(ctx, largestKey, largest); err != nil {
+		return err
+	}
+	delete(s.files, largestKey)
+	return nil
+}
+
+// spillToDisk moves file's buffered bytes to a temporary on-disk file and
+// releases their share of the memory account. Subsequent writes to file are
+// appended directly to the spill file and are no longer memory-accounted.
+// reserveMemory never calls this for a parquet file: file.buf is empty for
+// one until its row group closes, so there would be nothing to move and
+// nothing genuinely freed.
+func (s *cloudStorageSink) spillToDisk(ctx context.Context, file *cloudStorageSinkFile) error {
+	if file.spill != nil {
+		return nil
+	}
+	// The current chunk was being compressed into file.buf; finalize it so
+	// the bytes we're about to move are complete and well-formed.
+	if err := s.finalizeChunk(file); err != nil {
+		return err
+	}
+	spill, err := newCloudStorageSinkSpillFile()
+	if err != nil {
+		return err
+	}
+	if file.buf.Len() > 0 {
+		if _, err := spill.Write(file.buf.Bytes()); err != nil {
+			return err
+		}
+		file.buf.Reset()
+	}
+	file.spill = spill
+	if s.acc != nil && file.accountedBytes > 0 {
+		s.acc.Shrink(ctx, file.accountedBytes)
+		file.accountedBytes = 0
+	}
+	return nil
+}
+
+// avroOCFMagic is the 4-byte header every Avro Object Container File starts
+// with: "Obj" followed by the format version.
+var avroOCFMagic = []byte{'O', 'b', 'j', 1}
+
+// writeAvroLong writes v as an Avro `long`: a zig-zag encoded variable-length
+// integer.
+func writeAvroLong(w io.Writer, v int64) (int64, error) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	written, err := w.Write(buf[:n])
+	return int64(written), err
+}
+
+// writeAvroBytes writes b as an Avro `bytes`: its length as a `long`
+// followed by the raw bytes.
+func writeAvroBytes(w io.Writer, b []byte) (int64, error) {
+	n, err := writeAvroLong(w, int64(len(b)))
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(b)
+	return n + int64(m), err
+}
+
+// writeAvroOCFHeader writes the Object Container File header -- magic bytes,
+// the file's metadata (an avro.schema/avro.codec map), and a random sync
+// marker -- pinning the Avro schema for every record that follows in this
+// file. Per cloudStorageSinkKey, a file never spans more than one
+// table.Version, so the schema is fixed for the file's lifetime.
+func (s *cloudStorageSink) writeAvroOCFHeader(
+	w io.Writer, file *cloudStorageSinkFile, table *sqlbase.TableDescriptor,
+) (int64, error) {
+	schema, err := tableToAvroSchema(table)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	n, err := w.Write(avroOCFMagic)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	// The metadata map is encoded as a single two-entry block followed by a
+	// zero-length block terminator.
+	m, err := writeAvroLong(w, 2)
+	written += m
+	if err != nil {
+		return written, err
+	}
+	for _, kv := range [][2][]byte{
+		{[]byte(`avro.schema`), []byte(schema)},
+		{[]byte(`avro.codec`), []byte(`null`)},
+	} {
+		m, err := writeAvroBytes(w, kv[0])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		m, err = writeAvroBytes(w, kv[1])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	m, err = writeAvroLong(w, 0)
+	written += m
+	if err != nil {
+		return written, err
+	}
+
+	if _, err := rand.Read(file.ocfSyncMarker[:]); err != nil {
+		return written, err
+	}
+	n, err = w.Write(file.ocfSyncMarker[:])
+	written += int64(n)
+	file.ocfHeaderWritten = true
+	return written, err
+}
+
+// writeAvroOCFBlock appends record as a single-record OCF block: the record
+// count, the byte length of the block data, the data itself, and the file's
+// sync marker. Wrapping every record in its own block (rather than batching
+// several per block) keeps each EmitRow call self-contained, which is what
+// lets flushFile cut a chunk or a file between any two EmitRow calls.
+func (s *cloudStorageSink) writeAvroOCFBlock(
+	w io.Writer, file *cloudStorageSinkFile, record []byte,
+) (int64, error) {
+	var written int64
+	m, err := writeAvroLong(w, 1)
+	written += m
+	if err != nil {
+		return written, err
+	}
+	m, err = writeAvroLong(w, int64(len(record)))
+	written += m
+	if err != nil {
+		return written, err
+	}
+	n, err := w.Write(record)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	n, err = w.Write(file.ocfSyncMarker[:])
+	written += int64(n)
+	return written, err
+}
+
 // EmitResolvedTimestamp implements the Sink interface.
 func (s *cloudStorageSink) EmitResolvedTimestamp(
 	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
@@ -266,7 +1053,20 @@ func (s *cloudStorageSink) Flush(ctx context.Context) error {
 func (s *cloudStorageSink) flushFile(
 	ctx context.Context, key cloudStorageSinkKey, file *cloudStorageSinkFile,
 ) error {
-	if file.buf.Len() == 0 {
+	// The current chunk must be finalized before uploading so that every
+	// chunk in the index is independently decodable.
+	if err := s.finalizeChunk(file); err != nil {
+		return err
+	}
+	// Closing the row group is what actually writes the buffered rows --
+	// as column chunks, followed by the footer -- to file.out().
+	if file.parquetWriter != nil {
+		if err := file.parquetWriter.Close(); err != nil {
+			return err
+		}
+	}
+
+	if file.outLen() == 0 {
 		// This method shouldn't be called with an empty file, but be defensive
 		// about not writing empty files anyway.
 		return nil
@@ -284,11 +1084,62 @@ func (s *cloudStorageSink) flushFile(
 	if log.V(1) {
 		log.Info(ctx, "writing ", filename)
 	}
-	return s.es.WriteFile(ctx, filepath.Join(part, filename), bytes.NewReader(file.buf.Bytes()))
+
+	var body io.Reader
+	if file.spill != nil {
+		r, err := file.spill.reader()
+		if err != nil {
+			return err
+		}
+		body = r
+	} else {
+		body = bytes.NewReader(file.buf.Bytes())
+	}
+	if err := s.es.WriteFile(ctx, filepath.Join(part, filename), body); err != nil {
+		return err
+	}
+	if file.spill != nil {
+		if err := file.spill.close(); err != nil {
+			return err
+		}
+	} else if s.acc != nil && file.accountedBytes > 0 {
+		s.acc.Shrink(ctx, file.accountedBytes)
+		file.accountedBytes = 0
+	}
+
+	if s.newCompressionWriter != nil {
+		indexJSON, err := json.Marshal(cloudStorageSinkIndex{Chunks: file.index})
+		if err != nil {
+			return err
+		}
+		indexFilename := filename + `.index`
+		if log.V(1) {
+			log.Info(ctx, "writing ", indexFilename)
+		}
+		if err := s.es.WriteFile(
+			ctx, filepath.Join(part, indexFilename), bytes.NewReader(indexJSON),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metrics returns the sink's memory high-water metric, for registration with
+// the changefeed job's metric registry.
+func (s *cloudStorageSink) Metrics() *metric.Gauge {
+	return s.memoryHighWater
 }
 
 // Close implements the Sink interface.
 func (s *cloudStorageSink) Close() error {
+	for _, file := range s.files {
+		if file.spill != nil {
+			if err := file.spill.close(); err != nil {
+				return err
+			}
+		}
+	}
 	s.files = nil
 	return s.es.Close()
 }
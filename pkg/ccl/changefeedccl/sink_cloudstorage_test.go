@@ -0,0 +1,571 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/parquet"
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeExportStorage is a minimal, in-memory storageccl.ExportStorage used by
+// tests that need to observe what a cloudStorageSink actually uploads,
+// without talking to real cloud storage.
+type fakeExportStorage struct {
+	mu struct {
+		sync.Mutex
+		files map[string][]byte
+	}
+}
+
+func newFakeExportStorage() *fakeExportStorage {
+	e := &fakeExportStorage{}
+	e.mu.files = make(map[string][]byte)
+	return e
+}
+
+func (e *fakeExportStorage) Conf() roachpb.ExportStorage { return roachpb.ExportStorage{} }
+
+func (e *fakeExportStorage) ReadFile(_ context.Context, basename string) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	content, ok := e.mu.files[basename]
+	if !ok {
+		return nil, errors.Errorf(`no such file: %s`, basename)
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (e *fakeExportStorage) WriteFile(_ context.Context, basename string, content io.Reader) error {
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mu.files[basename] = b
+	return nil
+}
+
+func (e *fakeExportStorage) Delete(_ context.Context, basename string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.mu.files, basename)
+	return nil
+}
+
+func (e *fakeExportStorage) Close() error { return nil }
+
+func (e *fakeExportStorage) snapshot() map[string][]byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make(map[string][]byte, len(e.mu.files))
+	for k, v := range e.mu.files {
+		out[k] = v
+	}
+	return out
+}
+
+// makeTestBoundAccount returns a mon.BoundAccount backed by a monitor with a
+// budget of exactly budget bytes, for tests that need to observe how a
+// cloudStorageSink behaves as it approaches changefeed.sink.cloud_storage.memory_budget.
+func makeTestBoundAccount(ctx context.Context, t *testing.T, budget int64) (*mon.BoundAccount, func()) {
+	monitor := mon.MakeMonitor(
+		"test-cloudstorage-sink", mon.MemoryResource, nil, nil, 0, math.MaxInt64,
+	)
+	monitor.Start(ctx, nil, mon.MakeStandaloneBudget(budget))
+	acc := monitor.MakeBoundAccount()
+	return &acc, func() {
+		acc.Close(ctx)
+		monitor.Stop(ctx)
+	}
+}
+
+// TestCloudStorageSinkChunkedCompression verifies that the chunked
+// compression scheme added for the `compression` option produces chunks
+// that are each independently decodable, and that decoding every chunk in
+// order and concatenating the results reproduces the original, uncompressed
+// record stream.
+func TestCloudStorageSinkChunkedCompression(t *testing.T) {
+	const chunkSize = 16 // tiny, to force several chunks in this test
+
+	s := &cloudStorageSink{
+		newCompressionWriter: newGzipCompressionWriter,
+		chunkSize:            chunkSize,
+	}
+	file := &cloudStorageSinkFile{}
+
+	records := []string{
+		`{"a": 1}`,
+		`{"a": 2}`,
+		`{"a": 3}`,
+		`{"a": 4}`,
+		`{"a": 5}`,
+	}
+	var expected bytes.Buffer
+	for _, r := range records {
+		w, err := s.chunkWriter(file, hlc.Timestamp{})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(r))
+		require.NoError(t, err)
+		_, err = w.Write([]byte{'\n'})
+		require.NoError(t, err)
+		expected.WriteString(r)
+		expected.WriteByte('\n')
+
+		file.chunkRawWritten += int64(len(r)) + 1
+		if file.chunkRawWritten >= chunkSize {
+			require.NoError(t, s.finalizeChunk(file))
+		}
+	}
+	require.NoError(t, s.finalizeChunk(file))
+	require.True(t, len(file.index) > 1, "test should exercise more than one chunk")
+
+	var decoded bytes.Buffer
+	buf := file.buf.Bytes()
+	for i, entry := range file.index {
+		end := int64(len(buf))
+		if i+1 < len(file.index) {
+			end = file.index[i+1].CompressedOffset
+		}
+		chunk := buf[entry.CompressedOffset:end]
+		r, err := gzip.NewReader(bytes.NewReader(chunk))
+		require.NoError(t, err)
+		_, err = decoded.ReadFrom(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+	}
+	require.Equal(t, expected.String(), decoded.String())
+}
+
+// TestCloudStorageSinkAvroOCFRoundTrip verifies that the OCF framing
+// primitives added for `format=experimental_avro` (writeAvroLong,
+// writeAvroBytes, writeAvroOCFBlock) produce a file a standard Avro library
+// can decode. The schema-derivation step (tableToAvroSchema) lives outside
+// this file, so the header's schema is supplied directly here; everything
+// after the header exercises the real production code.
+func TestCloudStorageSinkAvroOCFRoundTrip(t *testing.T) {
+	const schemaJSON = `{"type":"record","name":"value","fields":[{"name":"a","type":"long"}]}`
+	codec, err := goavro.NewCodec(schemaJSON)
+	require.NoError(t, err)
+
+	s := &cloudStorageSink{ocf: true}
+	file := &cloudStorageSinkFile{}
+	copy(file.ocfSyncMarker[:], "0123456789abcdef")
+	file.ocfHeaderWritten = true
+
+	var buf bytes.Buffer
+	_, err = buf.Write(avroOCFMagic)
+	require.NoError(t, err)
+	_, err = writeAvroLong(&buf, 2)
+	require.NoError(t, err)
+	for _, kv := range [][2][]byte{
+		{[]byte(`avro.schema`), []byte(schemaJSON)},
+		{[]byte(`avro.codec`), []byte(`null`)},
+	} {
+		_, err = writeAvroBytes(&buf, kv[0])
+		require.NoError(t, err)
+		_, err = writeAvroBytes(&buf, kv[1])
+		require.NoError(t, err)
+	}
+	_, err = writeAvroLong(&buf, 0)
+	require.NoError(t, err)
+	_, err = buf.Write(file.ocfSyncMarker[:])
+	require.NoError(t, err)
+
+	records := []map[string]interface{}{{"a": int64(1)}, {"a": int64(2)}, {"a": int64(3)}}
+	for _, rec := range records {
+		encoded, err := codec.BinaryFromNative(nil, rec)
+		require.NoError(t, err)
+		_, err = s.writeAvroOCFBlock(&buf, file, encoded)
+		require.NoError(t, err)
+	}
+
+	r, err := goavro.NewOCFReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	var decoded []map[string]interface{}
+	for r.Scan() {
+		datum, err := r.Read()
+		require.NoError(t, err)
+		decoded = append(decoded, datum.(map[string]interface{}))
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, records, decoded)
+}
+
+// TestCloudStorageSinkMemoryBudget simulates many concurrent topics/schemas
+// sharing a single, tightly-budgeted mon.BoundAccount and verifies the sink
+// never grows it past the budget, and that a file that's spilled to disk
+// uploads exactly the same bytes a file that never spilled would have. Both
+// sub-tests drive the scenario through real EmitRow calls, the path
+// production traffic actually takes, rather than hand-rolling
+// reserveMemory/growAccount calls directly -- which is what let the
+// format=parquet accounting hole (TestCloudStorageSinkParquetMemoryAccounting)
+// go uncaught for a full review round.
+func TestCloudStorageSinkMemoryBudget(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("many concurrent topics stay within budget", func(t *testing.T) {
+		const budget = 200
+		acc, cleanup := makeTestBoundAccount(ctx, t, budget)
+		defer cleanup()
+
+		es := newFakeExportStorage()
+		s := &cloudStorageSink{
+			acc:               acc,
+			es:                es,
+			files:             make(map[cloudStorageSinkKey]*cloudStorageSinkFile),
+			partitionFormat:   `2006-01-02`,
+			ext:               `.ndjson`,
+			recordDelimFn: func(w io.Writer) error {
+				_, err := w.Write([]byte{'\n'})
+				return err
+			},
+			targetMaxFileSize: math.MaxInt64,
+			memoryHighWater:   metric.NewGauge(cloudStorageSinkMemoryHighWaterMetadata),
+		}
+		value := bytes.Repeat([]byte{'x'}, 50)
+
+		var keys []cloudStorageSinkKey
+		for i := 0; i < 10; i++ {
+			table := &sqlbase.TableDescriptor{Name: fmt.Sprintf(`topic%d`, i)}
+			key := cloudStorageSinkKey{Topic: table.Name, SchemaID: table.Version}
+			keys = append(keys, key)
+			s.files[key] = &cloudStorageSinkFile{}
+
+			require.NoError(t, s.EmitRow(ctx, table, nil, value, hlc.Timestamp{WallTime: int64(i + 1)}))
+			require.LessOrEqual(t, s.acc.Used(), int64(budget))
+		}
+
+		// 10 topics * 50+ bytes each don't fit in a 200 byte budget, so the
+		// sink must have relieved the pressure somehow -- by flushing a file
+		// early (removing it from s.files) or by spilling one to disk.
+		var sawSpill, sawEarlyFlush bool
+		for _, key := range keys {
+			if file, ok := s.files[key]; ok {
+				if file.spill != nil {
+					sawSpill = true
+				}
+			} else {
+				sawEarlyFlush = true
+			}
+		}
+		require.True(t, sawSpill || sawEarlyFlush,
+			"expected budget pressure to trigger a spill or an early flush")
+
+		for key, file := range s.files {
+			require.NoError(t, s.flushFile(ctx, key, file))
+		}
+		require.Equal(t, int64(0), s.acc.Used())
+
+		want := append(append([]byte{}, value...), '\n')
+		for name, content := range es.snapshot() {
+			require.Equal(t, want, content, "file %s", name)
+		}
+		require.NotEmpty(t, es.snapshot())
+	})
+
+	t.Run("spilled files upload identically to in-memory ones", func(t *testing.T) {
+		const budget = 100
+		acc, cleanup := makeTestBoundAccount(ctx, t, budget)
+		defer cleanup()
+
+		es := newFakeExportStorage()
+		s := &cloudStorageSink{
+			acc:               acc,
+			es:                es,
+			files:             make(map[cloudStorageSinkKey]*cloudStorageSinkFile),
+			partitionFormat:   `2006-01-02`,
+			ext:               `.ndjson`,
+			recordDelimFn: func(w io.Writer) error {
+				_, err := w.Write([]byte{'\n'})
+				return err
+			},
+			targetMaxFileSize: math.MaxInt64,
+			memoryHighWater:   metric.NewGauge(cloudStorageSinkMemoryHighWaterMetadata),
+		}
+
+		table := &sqlbase.TableDescriptor{Name: `only`}
+		key := cloudStorageSinkKey{Topic: table.Name, SchemaID: table.Version}
+		s.files[key] = &cloudStorageSinkFile{}
+		valueA := bytes.Repeat([]byte{'a'}, 20)
+		valueB := bytes.Repeat([]byte{'b'}, 20)
+
+		// This row fits in the budget.
+		require.NoError(t, s.EmitRow(ctx, table, nil, valueA, hlc.Timestamp{WallTime: 1}))
+		file := s.files[key]
+		require.Nil(t, file.spill)
+
+		// This one doesn't -- there's no other open file to flush to make
+		// room, so the file must spill.
+		require.NoError(t, s.EmitRow(ctx, table, nil, valueB, hlc.Timestamp{WallTime: 2}))
+		require.NotNil(t, file.spill)
+		require.Equal(t, int64(0), s.acc.Used())
+
+		require.NoError(t, s.flushFile(ctx, key, file))
+
+		files := es.snapshot()
+		require.Len(t, files, 1)
+		want := append(append(append([]byte{}, valueA...), '\n'), append(valueB, '\n')...)
+		for _, content := range files {
+			require.Equal(t, want, content)
+		}
+	})
+}
+
+func testParquetTable() *sqlbase.TableDescriptor {
+	return &sqlbase.TableDescriptor{
+		Name: `foo`,
+		Columns: []sqlbase.ColumnDescriptor{
+			{Name: `a`, Type: sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}},
+			{Name: `b`, Type: sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}},
+		},
+	}
+}
+
+// TestCloudStorageSinkParquetRoundTrip verifies that a Parquet file produced
+// by newParquetWriter/writeParquetRow can be read back with a standard
+// Parquet reader, and that both the row's own columns (converted to their
+// real Parquet types, not json.Unmarshal's generic float64/string/bool/nil)
+// and its __crdb__ metadata (updated ts, mvcc ts) round-trip.
+func TestCloudStorageSinkParquetRoundTrip(t *testing.T) {
+	table := testParquetTable()
+	s := &cloudStorageSink{parquet: true}
+	file := &cloudStorageSinkFile{}
+
+	pw, err := s.newParquetWriter(cloudStorageSinkFileWriter{file: file}, table)
+	require.NoError(t, err)
+	file.parquetWriter = pw
+
+	updated := hlc.Timestamp{WallTime: 123, Logical: 4}
+	_, err = s.writeParquetRow(file, table, []byte(`{"a": 1, "b": "x"}`), updated)
+	require.NoError(t, err)
+	require.NoError(t, file.parquetWriter.Close())
+	require.True(t, file.outLen() > 0)
+
+	pr, err := parquet.NewReader(bytes.NewReader(file.buf.Bytes()), file.outLen())
+	require.NoError(t, err)
+	row, err := pr.ReadRow()
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(1), `x`, updated.String(), updated.WallTime}, row)
+	_, err = pr.ReadRow()
+	require.Equal(t, io.EOF, err)
+}
+
+// TestCloudStorageSinkParquetColumnTypeConversion verifies that
+// parquetValueForColumn (via writeParquetRow) converts each column's
+// json.Unmarshal-decoded value to its actual Parquet type -- rather than
+// handing encoding/json's generic float64-for-every-number decoding straight
+// to the writer -- and that a missing/NULL field round-trips as nil instead
+// of erroring or silently dropping the column.
+func TestCloudStorageSinkParquetColumnTypeConversion(t *testing.T) {
+	table := &sqlbase.TableDescriptor{
+		Name: `foo`,
+		Columns: []sqlbase.ColumnDescriptor{
+			{Name: `a`, Type: sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}},
+			{Name: `b`, Type: sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_DECIMAL}},
+			{Name: `c`, Type: sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_STRING}},
+		},
+	}
+	s := &cloudStorageSink{parquet: true}
+	file := &cloudStorageSinkFile{}
+	pw, err := s.newParquetWriter(cloudStorageSinkFileWriter{file: file}, table)
+	require.NoError(t, err)
+	file.parquetWriter = pw
+
+	updated := hlc.Timestamp{WallTime: 55}
+	_, err = s.writeParquetRow(file, table, []byte(`{"a": 42, "b": "19.99", "c": null}`), updated)
+	require.NoError(t, err)
+	require.NoError(t, file.parquetWriter.Close())
+
+	pr, err := parquet.NewReader(bytes.NewReader(file.buf.Bytes()), file.outLen())
+	require.NoError(t, err)
+	row, err := pr.ReadRow()
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(42), `19.99`, nil, updated.String(), updated.WallTime}, row)
+
+	// A column whose JSON value doesn't match its declared Parquet type must
+	// be a hard error, not a silent float64/string coercion.
+	badFile := &cloudStorageSinkFile{}
+	pw, err = s.newParquetWriter(cloudStorageSinkFileWriter{file: badFile}, table)
+	require.NoError(t, err)
+	badFile.parquetWriter = pw
+	_, err = s.writeParquetRow(badFile, table, []byte(`{"a": "not a number"}`), updated)
+	require.Error(t, err)
+}
+
+// TestCloudStorageSinkParquetSpillWriteThrough verifies that
+// cloudStorageSinkFileWriter keeps a parquet file's output correct if its
+// row group is spilled to disk after rows have already been added to it --
+// reserveMemory itself never does this anymore (see reserveMemory and
+// TestCloudStorageSinkParquetMemoryAccounting: spilling a parquet file
+// frees none of its row-group memory, so it no longer relieves pressure),
+// but spillToDisk is still reachable and must remain write-through-safe.
+func TestCloudStorageSinkParquetSpillWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	table := testParquetTable()
+	es := newFakeExportStorage()
+	s := &cloudStorageSink{
+		parquet:           true,
+		ext:               `.parquet`,
+		recordDelimFn:     func(io.Writer) error { return nil },
+		es:                es,
+		files:             make(map[cloudStorageSinkKey]*cloudStorageSinkFile),
+		partitionFormat:   `2006-01-02`,
+		targetMaxFileSize: math.MaxInt64,
+	}
+	key := cloudStorageSinkKey{Topic: `foo`}
+	file := &cloudStorageSinkFile{}
+	s.files[key] = file
+
+	pw, err := s.newParquetWriter(cloudStorageSinkFileWriter{file: file}, table)
+	require.NoError(t, err)
+	file.parquetWriter = pw
+
+	updated := hlc.Timestamp{WallTime: 99}
+	_, err = s.writeParquetRow(file, table, []byte(`{"a": 7, "b": "y"}`), updated)
+	require.NoError(t, err)
+
+	// Nothing in production code spills a parquet file mid-row-group anymore,
+	// but force it here to confirm the writer adapter is still safe if
+	// something does.
+	require.NoError(t, s.spillToDisk(ctx, file))
+	require.NotNil(t, file.spill)
+
+	require.NoError(t, s.flushFile(ctx, key, file))
+
+	files := es.snapshot()
+	require.Len(t, files, 1)
+	var content []byte
+	for _, c := range files {
+		content = c
+	}
+	require.NotEmpty(t, content)
+
+	pr, err := parquet.NewReader(bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	row, err := pr.ReadRow()
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(7), `y`, updated.String(), updated.WallTime}, row)
+}
+
+// TestCloudStorageSinkParquetMemoryAccounting drives real EmitRow calls for
+// format=parquet -- rather than hand-rolling the scenario -- to verify that
+// the memory account reflects every still-buffered row instead of netting
+// back to zero after the first one (the bug: writeParquetRow only calls
+// parquetWriter.AddRow, which buffers the row inside the writer's own
+// row group, never touching file.buf/file.spill, so the outLen()-based
+// reconciliation in EmitRow always saw a zero delta and immediately
+// refunded the whole per-row estimate). It also verifies
+// flushLargestOtherFile can relieve a parquet file's pressure by closing
+// another file's row group, and that reserveMemory surfaces a real error,
+// rather than silently admitting unaccounted memory, when no file is left
+// to relieve it.
+func TestCloudStorageSinkParquetMemoryAccounting(t *testing.T) {
+	ctx := context.Background()
+	table := testParquetTable()
+	value := []byte(`{"a": 1, "b": "x"}`)
+	// Matches the memEstimate EmitRow computes per row: len(value) + 64.
+	perRowEstimate := int64(len(value)) + 64
+
+	newSink := func(es *fakeExportStorage, acc *mon.BoundAccount) *cloudStorageSink {
+		return &cloudStorageSink{
+			parquet:           true,
+			ext:               `.parquet`,
+			recordDelimFn:     func(io.Writer) error { return nil },
+			acc:               acc,
+			es:                es,
+			files:             make(map[cloudStorageSinkKey]*cloudStorageSinkFile),
+			partitionFormat:   `2006-01-02`,
+			targetMaxFileSize: math.MaxInt64,
+			memoryHighWater:   metric.NewGauge(cloudStorageSinkMemoryHighWaterMetadata),
+		}
+	}
+
+	t.Run("charge accumulates across in-flight rows instead of netting to zero", func(t *testing.T) {
+		budget := perRowEstimate*3 + 10
+		acc, cleanup := makeTestBoundAccount(ctx, t, budget)
+		defer cleanup()
+		s := newSink(newFakeExportStorage(), acc)
+		key := cloudStorageSinkKey{Topic: table.Name, SchemaID: table.Version}
+		s.files[key] = &cloudStorageSinkFile{}
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, s.EmitRow(ctx, table, nil, value, hlc.Timestamp{WallTime: int64(i + 1)}))
+			// With the accounting bug fixed here, a row's estimate is no
+			// longer immediately refunded, so this must keep growing instead
+			// of reading back 0 after the first iteration.
+			require.Equal(t, perRowEstimate*int64(i+1), s.acc.Used())
+		}
+	})
+
+	t.Run("flushLargestOtherFile can relieve a parquet file's pressure", func(t *testing.T) {
+		tableA := &sqlbase.TableDescriptor{Name: `a`, Columns: table.Columns}
+		tableB := &sqlbase.TableDescriptor{Name: `b`, Columns: table.Columns}
+		budget := perRowEstimate*2 + 10
+		acc, cleanup := makeTestBoundAccount(ctx, t, budget)
+		defer cleanup()
+		es := newFakeExportStorage()
+		s := newSink(es, acc)
+		s.files[cloudStorageSinkKey{Topic: tableA.Name, SchemaID: tableA.Version}] = &cloudStorageSinkFile{}
+		s.files[cloudStorageSinkKey{Topic: tableB.Name, SchemaID: tableB.Version}] = &cloudStorageSinkFile{}
+
+		require.NoError(t, s.EmitRow(ctx, tableA, nil, value, hlc.Timestamp{WallTime: 1}))
+		require.NoError(t, s.EmitRow(ctx, tableA, nil, value, hlc.Timestamp{WallTime: 2}))
+		require.Equal(t, perRowEstimate*2, s.acc.Used())
+
+		// tableB's row doesn't fit alongside tableA's two buffered rows, so
+		// tableA's file -- the only other open one -- must be flushed to make
+		// room, even though its row group was never written to file.buf.
+		require.NoError(t, s.EmitRow(ctx, tableB, nil, value, hlc.Timestamp{WallTime: 3}))
+		require.Equal(t, perRowEstimate, s.acc.Used())
+		require.Len(t, s.files, 1)
+		for k := range s.files {
+			require.Equal(t, `b`, k.Topic)
+		}
+		require.Len(t, es.snapshot(), 1)
+	})
+
+	t.Run("surfaces a real error when no file is left to relieve pressure", func(t *testing.T) {
+		budget := perRowEstimate + 5
+		acc, cleanup := makeTestBoundAccount(ctx, t, budget)
+		defer cleanup()
+		s := newSink(newFakeExportStorage(), acc)
+		key := cloudStorageSinkKey{Topic: table.Name, SchemaID: table.Version}
+		s.files[key] = &cloudStorageSinkFile{}
+
+		require.NoError(t, s.EmitRow(ctx, table, nil, value, hlc.Timestamp{WallTime: 1}))
+		require.Equal(t, perRowEstimate, s.acc.Used())
+
+		// The only open file is this one, so there's nothing for
+		// flushLargestOtherFile to flush; unlike every other format, a
+		// parquet file can't be spilled to make room either (see
+		// reserveMemory), so the budget error must surface here rather than
+		// being silently absorbed.
+		err := s.EmitRow(ctx, table, nil, value, hlc.Timestamp{WallTime: 2})
+		require.Error(t, err)
+		require.Equal(t, perRowEstimate, s.acc.Used())
+	})
+}